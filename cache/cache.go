@@ -0,0 +1,278 @@
+// Package cache implements an in-memory DNS answer cache keyed by the
+// question tuple (qname, qtype, qclass). Unlike a plain key/value cache it
+// stores the full *dns.Msg response, decrements every RR's TTL on retrieval,
+// and understands RFC 2308 negative caching.
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultMinTTL is the shortest time an entry is kept, even if the
+	// upstream returned a lower TTL. The TTLs in served records are not
+	// raised to it.
+	DefaultMinTTL = 1 * time.Second
+	// DefaultMaxTTL caps how long an entry is kept regardless of the
+	// upstream's advertised TTL.
+	DefaultMaxTTL = 1 * time.Hour
+	// prefetchWindow is how long before expiry a hot entry is
+	// eligible for an async refresh.
+	prefetchWindow = 5 * time.Second
+)
+
+// Key builds the cache key for a question, lower-casing the name so lookups
+// are case-insensitive per RFC 4343.
+func Key(qname string, qtype, qclass uint16) string {
+	return strings.ToLower(qname) + ":" + dns.TypeToString[qtype] + ":" + dns.ClassToString[qclass]
+}
+
+// entry is a single cached response plus the bookkeeping needed to age it.
+type entry struct {
+	key      string
+	msg      *dns.Msg
+	storedAt time.Time
+	ttl      time.Duration
+	hits     int
+
+	elem *list.Element
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return now.After(e.storedAt.Add(e.ttl))
+}
+
+// remaining returns how much of the original TTL is left, floored at zero.
+func (e *entry) remaining(now time.Time) time.Duration {
+	left := e.ttl - now.Sub(e.storedAt)
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// ResolveFunc resolves a question against the upstream, used by Prefetch to
+// refresh hot entries before they expire.
+type ResolveFunc func(q dns.Question) (*dns.Msg, error)
+
+// Cache is a size-bounded, LRU-evicted DNS answer cache.
+type Cache struct {
+	mu      sync.Mutex
+	items   map[string]*entry
+	lru     *list.List
+	maxSize int
+	minTTL  time.Duration
+	maxTTL  time.Duration
+
+	resolve  ResolveFunc
+	prefetch bool
+	stopCh   chan struct{}
+}
+
+// New creates a Cache bounded to maxSize entries, clamping every stored TTL
+// to [minTTL, maxTTL]. A maxSize of 0 means unbounded.
+func New(maxSize int, minTTL, maxTTL time.Duration) *Cache {
+	return &Cache{
+		items:   make(map[string]*entry),
+		lru:     list.New(),
+		maxSize: maxSize,
+		minTTL:  minTTL,
+		maxTTL:  maxTTL,
+	}
+}
+
+// EnablePrefetch turns on background refresh of hot entries shortly before
+// they expire, using resolve to re-query the upstream.
+func (c *Cache) EnablePrefetch(resolve ResolveFunc, interval time.Duration) {
+	c.mu.Lock()
+	c.resolve = resolve
+	c.prefetch = true
+	c.stopCh = make(chan struct{})
+	c.mu.Unlock()
+
+	go c.prefetchLoop(interval)
+}
+
+// Get returns the cached response for key, if any, with every RR's TTL
+// decremented by the time elapsed since it was stored. Expired entries are
+// evicted and reported as a miss.
+func (c *Cache) Get(key string) (*dns.Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	now := time.Now()
+	if e.expired(now) {
+		c.removeLocked(e)
+		return nil, false
+	}
+
+	e.hits++
+	c.lru.MoveToFront(e.elem)
+
+	elapsed := uint32(now.Sub(e.storedAt).Seconds())
+	msg := e.msg.Copy()
+	for _, rr := range msg.Answer {
+		rr.Header().Ttl = decrementTTL(rr.Header().Ttl, elapsed)
+	}
+	for _, rr := range msg.Ns {
+		rr.Header().Ttl = decrementTTL(rr.Header().Ttl, elapsed)
+	}
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		rr.Header().Ttl = decrementTTL(rr.Header().Ttl, elapsed)
+	}
+
+	return msg, true
+}
+
+func decrementTTL(ttl, elapsed uint32) uint32 {
+	if elapsed >= ttl {
+		return 0
+	}
+	return ttl - elapsed
+}
+
+// Set stores msg under key, computing its TTL from the minimum RR TTL in
+// the answer section, or from the SOA MINIMUM in the authority section for
+// negative (NXDOMAIN/NODATA) responses per RFC 2308. The stored TTL is
+// clamped to [minTTL, maxTTL].
+func (c *Cache) Set(key string, msg *dns.Msg) {
+	ttl := c.ttlFor(msg)
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.removeLocked(e)
+	}
+
+	e := &entry{key: key, msg: msg.Copy(), storedAt: time.Now(), ttl: ttl}
+	e.elem = c.lru.PushFront(e)
+	c.items[key] = e
+
+	if c.maxSize > 0 {
+		for len(c.items) > c.maxSize {
+			oldest := c.lru.Back()
+			if oldest == nil {
+				break
+			}
+			c.removeLocked(oldest.Value.(*entry))
+		}
+	}
+}
+
+// ttlFor derives the clamped TTL to store msg with.
+func (c *Cache) ttlFor(msg *dns.Msg) time.Duration {
+	var ttl time.Duration
+
+	if msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0 {
+		min := msg.Answer[0].Header().Ttl
+		for _, rr := range msg.Answer[1:] {
+			if rr.Header().Ttl < min {
+				min = rr.Header().Ttl
+			}
+		}
+		ttl = time.Duration(min) * time.Second
+	} else {
+		// Negative response: fall back to the SOA MINIMUM per RFC 2308.
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = time.Duration(soa.Minttl) * time.Second
+				break
+			}
+		}
+	}
+
+	if ttl <= 0 {
+		return 0
+	}
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	return ttl
+}
+
+// removeLocked evicts e. Callers must hold c.mu.
+func (c *Cache) removeLocked(e *entry) {
+	c.lru.Remove(e.elem)
+	delete(c.items, e.key)
+}
+
+// Len returns the number of entries currently cached.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.items)
+}
+
+// Stop halts the background prefetch loop, if running.
+func (c *Cache) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.prefetch {
+		close(c.stopCh)
+		c.prefetch = false
+	}
+}
+
+// prefetchLoop periodically refreshes entries that are hot (queried more
+// than once) and about to expire, so popular names rarely hit a cold cache.
+func (c *Cache) prefetchLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.refreshHotEntries()
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+func (c *Cache) refreshHotEntries() {
+	now := time.Now()
+
+	c.mu.Lock()
+	var due []dns.Question
+	for _, e := range c.items {
+		if e.hits > 1 && e.remaining(now) <= prefetchWindow {
+			due = append(due, e.msg.Question[0])
+		}
+	}
+	resolve := c.resolve
+	c.mu.Unlock()
+
+	if resolve == nil {
+		return
+	}
+
+	for _, q := range due {
+		msg, err := resolve(q)
+		if err != nil {
+			continue
+		}
+		c.Set(Key(q.Name, q.Qtype, q.Qclass), msg)
+	}
+}
@@ -0,0 +1,193 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func aMsg(name string, ttl uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	m.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+	}}
+	return m
+}
+
+func TestKeyLowercasesName(t *testing.T) {
+	got := Key("Example.COM.", dns.TypeA, dns.ClassINET)
+	want := Key("example.com.", dns.TypeA, dns.ClassINET)
+	if got != want {
+		t.Fatalf("Key not case-insensitive: %q != %q", got, want)
+	}
+}
+
+func TestGetMiss(t *testing.T) {
+	c := New(0, DefaultMinTTL, DefaultMaxTTL)
+	if _, ok := c.Get("missing"); ok {
+		t.Fatal("expected miss on empty cache")
+	}
+}
+
+func TestSetGetRoundTrip(t *testing.T) {
+	c := New(0, DefaultMinTTL, DefaultMaxTTL)
+	key := Key("example.com.", dns.TypeA, dns.ClassINET)
+	c.Set(key, aMsg("example.com.", 300))
+
+	msg, ok := c.Get(key)
+	if !ok {
+		t.Fatal("expected hit after Set")
+	}
+	if msg.Answer[0].Header().Ttl != 300 {
+		t.Fatalf("ttl = %d, want 300 (no time elapsed)", msg.Answer[0].Header().Ttl)
+	}
+}
+
+func TestGetDecrementsTTLAcrossAllSections(t *testing.T) {
+	c := New(0, 1*time.Second, DefaultMaxTTL)
+	key := Key("example.com.", dns.TypeNS, dns.ClassINET)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn("example.com."), dns.TypeNS)
+	msg.Answer = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: dns.Fqdn("example.com."), Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 100}, Ns: dns.Fqdn("ns1.example.com.")}}
+	msg.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: dns.Fqdn("example.com."), Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 100}, Ns: dns.Fqdn("ns2.example.com.")}}
+	msg.Extra = []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: dns.Fqdn("ns1.example.com."), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100}},
+		&dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Ttl: 100}},
+	}
+	c.Set(key, msg)
+
+	// Manually age the entry so elapsed > 0 without sleeping in the test.
+	c.mu.Lock()
+	c.items[key].storedAt = time.Now().Add(-10 * time.Second)
+	c.mu.Unlock()
+
+	got, ok := c.Get(key)
+	if !ok {
+		t.Fatal("expected hit")
+	}
+	if ttl := got.Answer[0].Header().Ttl; ttl != 90 {
+		t.Errorf("Answer TTL = %d, want 90", ttl)
+	}
+	if ttl := got.Ns[0].Header().Ttl; ttl != 90 {
+		t.Errorf("Ns TTL = %d, want 90", ttl)
+	}
+	if ttl := got.Extra[0].Header().Ttl; ttl != 90 {
+		t.Errorf("Extra A TTL = %d, want 90 (glue records must age too)", ttl)
+	}
+	if ttl := got.Extra[1].Header().Ttl; ttl != 100 {
+		t.Errorf("OPT TTL = %d, want untouched at 100", ttl)
+	}
+}
+
+func TestGetEvictsExpiredEntry(t *testing.T) {
+	c := New(0, 1*time.Second, DefaultMaxTTL)
+	key := Key("example.com.", dns.TypeA, dns.ClassINET)
+	c.Set(key, aMsg("example.com.", 1))
+
+	c.mu.Lock()
+	c.items[key].storedAt = time.Now().Add(-10 * time.Second)
+	c.mu.Unlock()
+
+	if _, ok := c.Get(key); ok {
+		t.Fatal("expected expired entry to be reported as a miss")
+	}
+	if c.Len() != 0 {
+		t.Fatalf("expired entry should be evicted, Len() = %d", c.Len())
+	}
+}
+
+// TestSetClampsStoredDuration verifies minTTL/maxTTL bound how long an entry
+// is kept (and thus when Get reports it expired), by clamping the internal
+// expiry TTL independently of the RR's own advertised TTL value.
+func TestSetClampsStoredDuration(t *testing.T) {
+	c := New(0, 10*time.Second, 60*time.Second)
+
+	lowKey := Key("low.example.com.", dns.TypeA, dns.ClassINET)
+	c.Set(lowKey, aMsg("low.example.com.", 1))
+	c.mu.Lock()
+	lowEntry := c.items[lowKey]
+	c.mu.Unlock()
+	if lowEntry.ttl != 10*time.Second {
+		t.Errorf("stored ttl = %v, want minTTL 10s clamp", lowEntry.ttl)
+	}
+
+	highKey := Key("high.example.com.", dns.TypeA, dns.ClassINET)
+	c.Set(highKey, aMsg("high.example.com.", 3600))
+	c.mu.Lock()
+	highEntry := c.items[highKey]
+	c.mu.Unlock()
+	if highEntry.ttl != 60*time.Second {
+		t.Errorf("stored ttl = %v, want maxTTL 60s clamp", highEntry.ttl)
+	}
+}
+
+func TestSetNegativeResponseUsesSOAMinimum(t *testing.T) {
+	c := New(0, DefaultMinTTL, DefaultMaxTTL)
+	key := Key("nope.example.com.", dns.TypeA, dns.ClassINET)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn("nope.example.com."), dns.TypeA)
+	msg.SetRcode(msg, dns.RcodeNameError)
+	msg.Ns = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: dns.Fqdn("example.com."), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Minttl: 45,
+	}}
+	c.Set(key, msg)
+
+	got, ok := c.Get(key)
+	if !ok {
+		t.Fatal("expected negative response to be cached per RFC 2308")
+	}
+	if got.Rcode != dns.RcodeNameError {
+		t.Fatalf("rcode = %v, want NXDOMAIN", got.Rcode)
+	}
+}
+
+func TestSetSkipsUncacheableResponse(t *testing.T) {
+	c := New(0, DefaultMinTTL, DefaultMaxTTL)
+	key := Key("nope.example.com.", dns.TypeA, dns.ClassINET)
+
+	// SERVFAIL with no SOA: nothing to derive a TTL from.
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn("nope.example.com."), dns.TypeA)
+	msg.SetRcode(msg, dns.RcodeServerFailure)
+	c.Set(key, msg)
+
+	if _, ok := c.Get(key); ok {
+		t.Fatal("expected SERVFAIL with no SOA to not be cached")
+	}
+}
+
+func TestMaxSizeEvictsLeastRecentlyUsed(t *testing.T) {
+	c := New(2, DefaultMinTTL, DefaultMaxTTL)
+
+	keyA := Key("a.example.com.", dns.TypeA, dns.ClassINET)
+	keyB := Key("b.example.com.", dns.TypeA, dns.ClassINET)
+	keyC := Key("c.example.com.", dns.TypeA, dns.ClassINET)
+
+	c.Set(keyA, aMsg("a.example.com.", 300))
+	c.Set(keyB, aMsg("b.example.com.", 300))
+
+	// Touch A so B becomes the least-recently-used entry.
+	if _, ok := c.Get(keyA); !ok {
+		t.Fatal("expected hit for a")
+	}
+
+	c.Set(keyC, aMsg("c.example.com.", 300))
+
+	if c.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", c.Len())
+	}
+	if _, ok := c.Get(keyB); ok {
+		t.Fatal("expected b to be evicted as least recently used")
+	}
+	if _, ok := c.Get(keyA); !ok {
+		t.Fatal("expected a to survive eviction")
+	}
+	if _, ok := c.Get(keyC); !ok {
+		t.Fatal("expected c to survive eviction")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// dnsMessageContentType is the RFC 8484 media type for wire-format DNS
+// messages carried over HTTP.
+const dnsMessageContentType = "application/dns-message"
+
+// dohAddr is a minimal net.Addr identifying a DoH client by its HTTP
+// remote address.
+type dohAddr string
+
+func (a dohAddr) Network() string { return "tcp" }
+func (a dohAddr) String() string  { return string(a) }
+
+// dohResponseWriter adapts an http.ResponseWriter to dns.ResponseWriter so
+// DoH requests are served by the same Handler used by the DoT/TCP/UDP
+// listeners.
+type dohResponseWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr         { return dohAddr("") }
+func (w *dohResponseWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *dohResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *dohResponseWriter) Close() error                { return nil }
+func (w *dohResponseWriter) TsigStatus() error           { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool)         {}
+func (w *dohResponseWriter) Hijack()                     {}
+
+// dohHandler serves DNS-over-HTTPS per RFC 8484, supporting both the GET
+// (base64url "dns" query parameter) and POST (application/dns-message body)
+// forms against h, the same Handler pipeline used by the other listeners.
+func dohHandler(h dns.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body []byte
+		var err error
+
+		switch req.Method {
+		case http.MethodGet:
+			q := req.URL.Query().Get("dns")
+			if q == "" {
+				http.Error(rw, "missing dns parameter", http.StatusBadRequest)
+				return
+			}
+			body, err = base64.RawURLEncoding.DecodeString(q)
+		case http.MethodPost:
+			if req.Header.Get("Content-Type") != dnsMessageContentType {
+				http.Error(rw, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			body, err = io.ReadAll(io.LimitReader(req.Body, dns.MaxMsgSize))
+		default:
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err != nil {
+			http.Error(rw, "invalid dns message", http.StatusBadRequest)
+			return
+		}
+
+		m := new(dns.Msg)
+		if err := m.Unpack(body); err != nil {
+			http.Error(rw, "invalid dns message", http.StatusBadRequest)
+			return
+		}
+
+		w := &dohResponseWriter{remote: dohAddr(req.RemoteAddr)}
+		h.ServeDNS(w, m)
+
+		if w.msg == nil {
+			http.Error(rw, "no response", http.StatusInternalServerError)
+			return
+		}
+
+		out, err := w.msg.Pack()
+		if err != nil {
+			http.Error(rw, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", dnsMessageContentType)
+		if _, err := rw.Write(out); err != nil {
+			log.Error(err)
+		}
+	})
+}
+
+// startDoH runs a DNS-over-HTTPS listener on addr, serving h over HTTP/2
+// with TLS.
+func startDoH(addr, certFile, keyFile string, h dns.Handler) error {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: dohHandler(h),
+	}
+	return srv.ListenAndServeTLS(certFile, keyFile)
+}
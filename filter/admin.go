@@ -0,0 +1,136 @@
+package filter
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxAdminBodySize bounds how much of a POST /rewrite or /allow request body
+// is read, so a caller cannot drive the process out of memory with an
+// oversized body.
+const maxAdminBodySize = 4096
+
+// status is the JSON body served by AdminHandler's GET /status.
+type status struct {
+	Enabled      bool `json:"enabled"`
+	BlockRules   int  `json:"block_rules"`
+	RewriteRules int  `json:"rewrite_rules"`
+}
+
+// rewriteRequest is the JSON body accepted by POST /rewrite.
+type rewriteRequest struct {
+	ClientIP string `json:"client_ip"` // empty applies the rewrite to every client
+	Name     string `json:"name"`
+	Type     string `json:"type"` // "A", "AAAA", or "CNAME"
+	Value    string `json:"value"`
+}
+
+// allowRequest is the JSON body accepted by POST /allow.
+type allowRequest struct {
+	ClientIP string `json:"client_ip"` // empty allows name for every client
+	Name     string `json:"name"`
+}
+
+// AdminHandler exposes f's enable state, rule counts, and rule mutations
+// over HTTP:
+//
+//	GET  /status  -> current enabled state and rule counts
+//	POST /enable  -> turn filtering on
+//	POST /disable -> turn filtering off
+//	POST /rewrite -> add a static rewrite, see rewriteRequest
+//	POST /allow   -> exempt a name from blocking, see allowRequest
+func (f *Filter) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		blockRules, rewriteRules := f.Counts()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status{
+			Enabled:      f.Enabled(),
+			BlockRules:   blockRules,
+			RewriteRules: rewriteRules,
+		})
+	})
+
+	mux.HandleFunc("/enable", func(w http.ResponseWriter, r *http.Request) {
+		f.Enable(true)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/disable", func(w http.ResponseWriter, r *http.Request) {
+		f.Enable(false)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/rewrite", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req rewriteRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxAdminBodySize)).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rrtype, ok := dns.StringToType[strings.ToUpper(req.Type)]
+		if !ok || (rrtype != dns.TypeA && rrtype != dns.TypeAAAA && rrtype != dns.TypeCNAME) {
+			http.Error(w, "rewrite type must be one of A, AAAA, CNAME, got "+req.Type, http.StatusBadRequest)
+			return
+		}
+		if rrtype == dns.TypeA && net.ParseIP(req.Value).To4() == nil {
+			http.Error(w, "rewrite value must be a valid IPv4 address for A", http.StatusBadRequest)
+			return
+		}
+		if rrtype == dns.TypeAAAA {
+			ip := net.ParseIP(req.Value)
+			if ip == nil || ip.To4() != nil {
+				http.Error(w, "rewrite value must be a valid IPv6 address for AAAA", http.StatusBadRequest)
+				return
+			}
+		}
+		if rrtype == dns.TypeCNAME {
+			if _, ok := dns.IsDomainName(req.Value); !ok {
+				http.Error(w, "rewrite value must be a valid domain name for CNAME", http.StatusBadRequest)
+				return
+			}
+		}
+		clientIP, ok := CanonicalClientIP(req.ClientIP)
+		if !ok {
+			http.Error(w, "client_ip must be a valid IP", http.StatusBadRequest)
+			return
+		}
+
+		f.AddRewrite(clientIP, req.Name, rrtype, req.Value)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/allow", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req allowRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxAdminBodySize)).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		clientIP, ok := CanonicalClientIP(req.ClientIP)
+		if !ok {
+			http.Error(w, "client_ip must be a valid IP", http.StatusBadRequest)
+			return
+		}
+
+		f.Allow(clientIP, req.Name)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux
+}
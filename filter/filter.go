@@ -0,0 +1,292 @@
+// Package filter implements client-facing DNS blocking, allowing, and
+// rewriting, applied before a query reaches the upstream resolver.
+package filter
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// BlockMode controls how a blocked query is answered.
+type BlockMode string
+
+const (
+	// BlockNXDOMAIN answers blocked names with NXDOMAIN.
+	BlockNXDOMAIN BlockMode = "nxdomain"
+	// BlockRefused answers blocked names with REFUSED.
+	BlockRefused BlockMode = "refused"
+	// BlockZeroIP answers blocked A/AAAA queries with 0.0.0.0 / ::.
+	BlockZeroIP BlockMode = "zero-ip"
+	// BlockSinkhole answers blocked A/AAAA queries with a configured
+	// sinkhole IP.
+	BlockSinkhole BlockMode = "sinkhole"
+)
+
+// Rewrite is a static A/AAAA/CNAME answer served without contacting the
+// upstream.
+type Rewrite struct {
+	Type  uint16
+	Value string
+}
+
+// Decision is the outcome of checking a question against a Filter.
+type Decision struct {
+	// Blocked is true if the query should not be forwarded upstream.
+	Blocked bool
+	// Rcode is the response code to use when Blocked is true and there
+	// is no Rewrite.
+	Rcode int
+	// SinkholeIP is set when Blocked is true and BlockMode resolves to
+	// an address instead of an error code.
+	SinkholeIP net.IP
+	// Rewrite is set when name matched a static rewrite rule.
+	Rewrite *Rewrite
+}
+
+// ruleSet is a single client's (or the default) block/allow/rewrite rules.
+type ruleSet struct {
+	exact     map[string]struct{}
+	wildcards []string // suffixes, e.g. "example.com." for "*.example.com."
+	regexes   []*regexp.Regexp
+	allow     map[string]struct{}
+	rewrites  map[string]Rewrite
+
+	// sources holds each blocklist source's own contribution, keyed by
+	// Source.Path, so a reload of one source can replace just its own
+	// entries in exact/wildcards/regexes without touching another
+	// source's.
+	sources map[string]sourceRules
+}
+
+// sourceRules is the block rules a single blocklist source contributed to a
+// ruleSet.
+type sourceRules struct {
+	exact     map[string]struct{}
+	wildcards []string
+	regexes   []*regexp.Regexp
+}
+
+func newRuleSet() *ruleSet {
+	return &ruleSet{
+		exact:    make(map[string]struct{}),
+		allow:    make(map[string]struct{}),
+		rewrites: make(map[string]Rewrite),
+		sources:  make(map[string]sourceRules),
+	}
+}
+
+// setSource replaces the block rules rs attributes to sourcePath and
+// recomputes exact/wildcards/regexes from every known source, so reloading a
+// source drops entries it no longer lists instead of accumulating forever.
+func (rs *ruleSet) setSource(sourcePath string, sr sourceRules) {
+	rs.sources[sourcePath] = sr
+
+	rs.exact = make(map[string]struct{})
+	rs.wildcards = nil
+	rs.regexes = nil
+	for _, s := range rs.sources {
+		for name := range s.exact {
+			rs.exact[name] = struct{}{}
+		}
+		rs.wildcards = append(rs.wildcards, s.wildcards...)
+		rs.regexes = append(rs.regexes, s.regexes...)
+	}
+}
+
+// matchesBlock reports whether name matches one of rs's block rules,
+// ignoring rs's own allowlist. Combining allow/block across the default and
+// per-client rulesets is Filter's job, not ruleSet's.
+func (rs *ruleSet) matchesBlock(name string) bool {
+	if _, ok := rs.exact[name]; ok {
+		return true
+	}
+	for _, suffix := range rs.wildcards {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	for _, re := range rs.regexes {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rs *ruleSet) allowed(name string) bool {
+	_, ok := rs.allow[name]
+	return ok
+}
+
+// Filter decides whether a question should be blocked, rewritten, or passed
+// through to the upstream, optionally applying a different ruleset per
+// client IP.
+type Filter struct {
+	mu sync.RWMutex
+
+	enabled    bool
+	blockMode  BlockMode
+	sinkholeIP net.IP
+
+	defaultRules *ruleSet
+	clientRules  map[string]*ruleSet
+}
+
+// New creates an enabled Filter that answers blocked names with mode,
+// serving sinkholeIP when mode is BlockSinkhole.
+func New(mode BlockMode, sinkholeIP net.IP) *Filter {
+	return &Filter{
+		enabled:      true,
+		blockMode:    mode,
+		sinkholeIP:   sinkholeIP,
+		defaultRules: newRuleSet(),
+		clientRules:  make(map[string]*ruleSet),
+	}
+}
+
+// Enable turns filtering on or off. When disabled, Check always reports an
+// unblocked decision.
+func (f *Filter) Enable(enabled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.enabled = enabled
+}
+
+// Enabled reports whether filtering is currently active.
+func (f *Filter) Enabled() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.enabled
+}
+
+// Counts returns the number of block and rewrite rules currently loaded
+// across the default ruleset and all per-client overrides.
+func (f *Filter) Counts() (blockRules, rewriteRules int) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	count := func(rs *ruleSet) {
+		blockRules += len(rs.exact) + len(rs.wildcards) + len(rs.regexes)
+		rewriteRules += len(rs.rewrites)
+	}
+	count(f.defaultRules)
+	for _, rs := range f.clientRules {
+		count(rs)
+	}
+	return blockRules, rewriteRules
+}
+
+// Check decides what to do with a question from clientIP. A per-client
+// ruleset (if one exists for clientIP) augments the default ruleset rather
+// than replacing it: a client-specific rewrite, allow, or block entry takes
+// full precedence over the default ruleset for that name, and the default
+// ruleset is only consulted when the client has no rule of its own for it.
+// Check takes f.mu for reading itself.
+func (f *Filter) Check(clientIP, name string) Decision {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if !f.enabled {
+		return Decision{}
+	}
+
+	name = strings.ToLower(name)
+
+	// The client's own rules, if any, take full precedence over the default
+	// ruleset for this name: whichever of rewrite/allow/block the client has
+	// set for name wins outright, without even consulting the default
+	// ruleset. Only when the client has no rule of its own for name do we
+	// fall back to the default ruleset.
+	if clientRS, hasClient := f.clientRules[clientIP]; hasClient {
+		if rw, ok := clientRS.rewrites[name]; ok {
+			rwCopy := rw
+			return Decision{Rewrite: &rwCopy}
+		}
+		if clientRS.allowed(name) {
+			return Decision{}
+		}
+		if clientRS.matchesBlock(name) {
+			return f.blockDecision()
+		}
+	}
+
+	if rw, ok := f.defaultRules.rewrites[name]; ok {
+		rwCopy := rw
+		return Decision{Rewrite: &rwCopy}
+	}
+	if f.defaultRules.allowed(name) {
+		return Decision{}
+	}
+	if f.defaultRules.matchesBlock(name) {
+		return f.blockDecision()
+	}
+
+	return Decision{}
+}
+
+// blockDecision builds the Decision for a name that has matched a block
+// rule, according to f.blockMode. Callers must hold f.mu for reading.
+func (f *Filter) blockDecision() Decision {
+	switch f.blockMode {
+	case BlockRefused:
+		return Decision{Blocked: true, Rcode: dns.RcodeRefused}
+	case BlockZeroIP:
+		return Decision{Blocked: true, SinkholeIP: net.IPv4zero}
+	case BlockSinkhole:
+		return Decision{Blocked: true, SinkholeIP: f.sinkholeIP}
+	default:
+		return Decision{Blocked: true, Rcode: dns.RcodeNameError}
+	}
+}
+
+// AddRewrite registers a static A/AAAA/CNAME answer for name, optionally
+// scoped to a single client IP (empty clientIP applies it to everyone).
+func (f *Filter) AddRewrite(clientIP, name string, rrtype uint16, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.ruleSetForWrite(clientIP).rewrites[strings.ToLower(dns.Fqdn(name))] = Rewrite{Type: rrtype, Value: value}
+}
+
+// Allow exempts the exact name from blocking, optionally scoped to a single
+// client IP. It does not exempt subdomains of name.
+func (f *Filter) Allow(clientIP, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.ruleSetForWrite(clientIP).allow[strings.ToLower(dns.Fqdn(name))] = struct{}{}
+}
+
+// ruleSetForWrite returns the ruleset to mutate for clientIP, creating a
+// per-client override if needed. Callers must hold f.mu for writing.
+func (f *Filter) ruleSetForWrite(clientIP string) *ruleSet {
+	if clientIP == "" {
+		return f.defaultRules
+	}
+	rs, ok := f.clientRules[clientIP]
+	if !ok {
+		rs = newRuleSet()
+		f.clientRules[clientIP] = rs
+	}
+	return rs
+}
+
+// CanonicalClientIP validates and normalizes a caller-supplied client IP so
+// it matches the form the proxy derives from a real connection (e.g. a
+// non-canonical IPv6 literal like "2001:DB8::1" would otherwise never match
+// the lowercase "2001:db8::1" a client actually connects from). An empty
+// clientIP is left as-is, since it scopes a rule to every client.
+func CanonicalClientIP(clientIP string) (string, bool) {
+	if clientIP == "" {
+		return "", true
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return "", false
+	}
+	return ip.String(), true
+}
@@ -2,35 +2,98 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
-	"github.com/patrickmn/go-cache"
+	"github.com/mxssl/dns-over-tls-proxy/cache"
+	"github.com/mxssl/dns-over-tls-proxy/filter"
+	"github.com/mxssl/dns-over-tls-proxy/metrics"
+	"github.com/mxssl/dns-over-tls-proxy/querylog"
+	"github.com/mxssl/dns-over-tls-proxy/ratelimit"
+	"github.com/mxssl/dns-over-tls-proxy/upstream"
+	"github.com/mxssl/dns-over-tls-proxy/upstream/dot"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
-// Handler handles ServeDNS
-type Handler struct{}
-
-// Answer is DNS A answer type
-type Answer struct {
-	ip  string
-	ttl uint32
+// Handler handles ServeDNS. protocol identifies which listener a query
+// arrived on ("udp", "tcp", "dot" or "doh"); it can't be derived from
+// dns.ResponseWriter.RemoteAddr().Network() alone, since DoT and DoH both
+// report "tcp".
+type Handler struct {
+	protocol string
 }
 
+const (
+	// rateLimitSweepInterval is how often idle rate-limiter buckets are
+	// evicted.
+	rateLimitSweepInterval = 1 * time.Minute
+	// rateLimitBucketTTL is how long a client's bucket is kept after its
+	// last query before being swept.
+	rateLimitBucketTTL = 10 * time.Minute
+	// dotPoolStatsInterval is how often the DoT pool gauges are refreshed.
+	dotPoolStatsInterval = 15 * time.Second
+)
+
 // CLI flags
 var (
-	ip       = flag.String("ip", "0.0.0.0", "IP address")
-	port     = flag.String("port", "53", "TCP/UDP Port")
-	resolver = flag.String("resolver", "1.1.1.1:853", "DNS-over-TLS resolver")
+	ip               = flag.String("ip", "0.0.0.0", "IP address")
+	port             = flag.String("port", "53", "TCP/UDP Port")
+	resolver         = flag.String("resolver", "1.1.1.1:853", "Comma-separated list of DNS-over-TLS resolvers, e.g. 1.1.1.1:853,8.8.8.8:853, each optionally suffixed with @duration to override -upstream-timeout for that one upstream")
+	strategy         = flag.String("strategy", string(upstream.StrategyFailover), "Upstream selection strategy: parallel, fastest or failover")
+	upstreamTimeout  = flag.Duration("upstream-timeout", upstream.DefaultTimeout, "Per-query upstream timeout, unless overridden per-resolver with @duration")
+	cacheSize        = flag.Int("cache-size", 10000, "Max number of cached DNS answers, 0 for unbounded")
+	cacheMinTTL      = flag.Duration("cache-min-ttl", cache.DefaultMinTTL, "Minimum time a cached answer is kept, even if its records' TTL is lower (served record TTLs are not raised)")
+	cacheMaxTTL      = flag.Duration("cache-max-ttl", cache.DefaultMaxTTL, "Maximum time a cached answer is kept, even if its records' TTL is higher (served record TTLs are not lowered)")
+	cachePrefetch    = flag.Bool("cache-prefetch", false, "Asynchronously refresh popular cache entries shortly before they expire")
+	dotListen        = flag.String("dot-listen", "", "Address to serve DNS-over-TLS on, e.g. :853 (disabled if empty)")
+	dohListen        = flag.String("doh-listen", "", "Address to serve DNS-over-HTTPS on, e.g. :443 (disabled if empty)")
+	tlsCert          = flag.String("tls-cert", "", "TLS certificate file, required for -dot-listen/-doh-listen")
+	tlsKey           = flag.String("tls-key", "", "TLS key file, required for -dot-listen/-doh-listen")
+	blocklist        = flag.String("blocklist", "", "Comma-separated list of blocklist files or URLs (hosts-file or plain domain-list format), each optionally suffixed with @clientIP to scope it to one LAN client")
+	blocklistRefresh = flag.Duration("blocklist-refresh", 0, "Interval to reload every -blocklist source, picking up additions/removals (0 to load once and never refresh)")
+	blockMode        = flag.String("block-mode", string(filter.BlockNXDOMAIN), "How to answer blocked names: nxdomain, refused, zero-ip or sinkhole")
+	sinkholeIP       = flag.String("sinkhole-ip", "", "IP address to return for blocked A/AAAA queries when -block-mode=sinkhole")
+	filterAdmin      = flag.String("filter-admin-listen", "", "Address to serve the filter admin HTTP endpoint on, e.g. :8080 (disabled if empty)")
+	metricsListen    = flag.String("metrics-listen", "", "Address to serve Prometheus metrics on, e.g. :9153 (disabled if empty)")
+	queryLogPath     = flag.String("querylog-path", "", "Path to write a rotating JSONL query log to (disabled if empty)")
+	queryLogAnon     = flag.Bool("querylog-anonymize-ip", false, "Zero the low bits of client IPs written to the query log")
+	rateLimitQPS     = flag.Float64("ratelimit-qps", 0, "Max queries per second per client IP, 0 to disable")
+	rateLimitBurst   = flag.Int("ratelimit-burst", 50, "Burst size for the per-client-IP rate limiter")
+	dotPoolSize      = flag.Int("dot-pool-size", dot.DefaultPoolSize, "Number of persistent, pipelined connections to open per DoT upstream")
+	dotMaxInFlight   = flag.Int("dot-max-inflight", dot.DefaultMaxInFlight, "Max pipelined queries in flight at once on a single DoT connection")
+	dotIdleTimeout   = flag.Duration("dot-idle-timeout", dot.DefaultIdleTimeout, "Interval at which an idle DoT connection is sent a keepalive probe; idle connections are not closed")
+	dotDialTimeout   = flag.Duration("dot-dial-timeout", dot.DefaultDialTimeout, "Timeout for a single DoT TLS handshake")
 )
 
+// pool is the set of configured upstream resolvers, built from the
+// -resolver and -strategy flags once flag.Parse has run.
+var pool *upstream.Pool
+
+// answers is the DNS answer cache, built from the -cache-* flags once
+// flag.Parse has run.
+var answers *cache.Cache
+
+// flt applies blocklists, allowlists, and static rewrites before a query is
+// forwarded upstream, built from the -blocklist/-block-mode flags once
+// flag.Parse has run.
+var flt *filter.Filter
+
+// limiter enforces the per-client-IP QPS/burst from the -ratelimit-* flags.
+var limiter *ratelimit.Limiter
+
+// qlog records every handled query to the rotating JSONL log configured by
+// -querylog-path, or is nil if query logging is disabled.
+var qlog *querylog.Logger
+
 func init() {
 	// Setup log format
 	log.SetFormatter(&log.JSONFormatter{})
@@ -38,13 +101,93 @@ func init() {
 	log.SetLevel(log.InfoLevel)
 }
 
-// Setup in-memory cache with default expirity and clean time
-var inmem = cache.New(1*time.Minute, 1*time.Minute)
-
 func main() {
 	// Parse CLI flags
 	flag.Parse()
 
+	// Build the upstream pool from the configured resolvers/strategy
+	var err error
+	pool, err = upstream.NewPool(*resolver, upstream.Strategy(*strategy), dot.Config{
+		Size:         *dotPoolSize,
+		MaxInFlight:  *dotMaxInFlight,
+		IdleTimeout:  *dotIdleTimeout,
+		DialTimeout:  *dotDialTimeout,
+		QueryTimeout: *upstreamTimeout,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Periodically refresh the DoT pool gauges
+	go func() {
+		ticker := time.NewTicker(dotPoolStatsInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			metrics.ObserveDotPoolStats(pool.DotStats())
+		}
+	}()
+
+	// Build the DNS answer cache
+	answers = cache.New(*cacheSize, *cacheMinTTL, *cacheMaxTTL)
+	if *cachePrefetch {
+		answers.EnablePrefetch(refresh, 1*time.Second)
+	}
+
+	// Build the client-facing filter and load its blocklists, if any. Each
+	// entry may be suffixed with "@clientIP" to scope that one list to a
+	// single LAN client instead of applying it globally.
+	flt = filter.New(filter.BlockMode(*blockMode), net.ParseIP(*sinkholeIP))
+	var blocklistSources []filter.Source
+	for _, src := range strings.Split(*blocklist, ",") {
+		src = strings.TrimSpace(src)
+		if src == "" {
+			continue
+		}
+		source := filter.ParseSource(src)
+		if err := flt.LoadBlocklist(source); err != nil {
+			log.Error(err)
+		}
+		blocklistSources = append(blocklistSources, source)
+	}
+	if *blocklistRefresh > 0 {
+		go flt.Refresh(blocklistSources, *blocklistRefresh, nil)
+	}
+
+	// Build the per-client-IP rate limiter, periodically evicting buckets
+	// for clients we haven't seen in a while so the map doesn't grow
+	// unbounded under a flood of spoofed source IPs
+	limiter = ratelimit.New(*rateLimitQPS, *rateLimitBurst)
+	go func() {
+		ticker := time.NewTicker(rateLimitSweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			limiter.Sweep(time.Now().Add(-rateLimitBucketTTL))
+		}
+	}()
+
+	// Build the query log, if enabled
+	if *queryLogPath != "" {
+		qlog = querylog.New(*queryLogPath, *queryLogAnon)
+	}
+
+	// Run the optional Prometheus metrics endpoint
+	if *metricsListen != "" {
+		go func() {
+			if err := http.ListenAndServe(*metricsListen, metrics.Handler()); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// Run the optional filter admin HTTP endpoint
+	if *filterAdmin != "" {
+		go func() {
+			if err := http.ListenAndServe(*filterAdmin, flt.AdminHandler()); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	// Build ip plus port string
 	ipPort := fmt.Sprintf("%v:%v", *ip, *port)
 
@@ -55,8 +198,8 @@ func main() {
 	srvUDP := &dns.Server{Addr: ipPort, Net: "udp"}
 
 	// Setup handler func
-	srvTCP.Handler = Handler{}
-	srvUDP.Handler = Handler{}
+	srvTCP.Handler = Handler{protocol: "tcp"}
+	srvUDP.Handler = Handler{protocol: "udp"}
 
 	// Run TCP server
 	go func() {
@@ -72,6 +215,40 @@ func main() {
 		}
 	}()
 
+	// Run the optional DNS-over-TLS listener
+	if *dotListen != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		srvDoT := &dns.Server{
+			Addr:      *dotListen,
+			Net:       "tcp-tls",
+			Handler:   Handler{protocol: "dot"},
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		}
+
+		go func() {
+			if err := srvDoT.ListenAndServe(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+
+		log.Printf("App is ready to accept DoT connections on %v", *dotListen)
+	}
+
+	// Run the optional DNS-over-HTTPS listener
+	if *dohListen != "" {
+		go func() {
+			if err := startDoH(*dohListen, *tlsCert, *tlsKey, Handler{protocol: "doh"}); err != nil {
+				log.Fatal(err)
+			}
+		}()
+
+		log.Printf("App is ready to accept DoH connections on %v", *dohListen)
+	}
+
 	log.Printf("App is ready to accept connections on %v TCP/UDP", srvTCP.Addr)
 
 	// Setup graceful shutdown channel
@@ -97,102 +274,268 @@ func main() {
 		log.Error(err)
 	}
 
+	if qlog != nil {
+		if err := qlog.Close(); err != nil {
+			log.Error(err)
+		}
+	}
+
 	os.Exit(0)
 }
 
 // ServeDNS handler for DNS inbound queries
-func (Handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	msg := dns.Msg{}
-	msg.SetReply(r)
-
+func (h Handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	// Check that DNS request exists
-	if len(r.Question) > 0 {
-
-		// Log DNS request
-		log.WithFields(log.Fields{
-			"remote_addr":      w.RemoteAddr().String(),
-			"requested_domain": r.Question[0].Name,
-			"protocol":         w.RemoteAddr().Network(),
-		}).Info("DNS request")
-
-		// Check question type
-		// Only A type is supported for now
-		if r.Question[0].Qtype == dns.TypeA {
-			domain := msg.Question[0].Name
-
-			// Resolve a domain name
-			answer, useCache, err := resolveOverTLS(domain, *resolver)
-			if err != nil {
-				log.Println(err)
-			}
-			log.WithFields(log.Fields{
-				"use_cache": useCache,
-			}).Info("Cache usage")
-
-			// Create a DNS response
-			msg.Answer = append(msg.Answer, &dns.A{
-				Hdr: dns.RR_Header{Name: domain,
-					Rrtype: dns.TypeA,
-					Class:  dns.ClassINET,
-					Ttl:    answer.ttl,
-				},
-				A: net.ParseIP(answer.ip),
-			})
-
-			// Send a response back to a client
-			if err := w.WriteMsg(&msg); err != nil {
-				log.Error(err)
-			}
-			return
+	if len(r.Question) == 0 {
+		log.Error("Empty DNS question")
+		return
+	}
+
+	start := time.Now()
+	q := r.Question[0]
+	protocol := h.protocol
+	clientIP := clientIPFromAddr(w.RemoteAddr())
+
+	// Log DNS request
+	log.WithFields(log.Fields{
+		"remote_addr":      w.RemoteAddr().String(),
+		"requested_domain": q.Name,
+		"qtype":            dns.TypeToString[q.Qtype],
+		"protocol":         protocol,
+	}).Info("DNS request")
+
+	metrics.InFlightQueries.Inc()
+	defer metrics.InFlightQueries.Dec()
+
+	// Protect the proxy from being used as an amplification vector with a
+	// per-client-IP token-bucket rate limit
+	if !limiter.Allow(clientIP) {
+		log.WithFields(log.Fields{"client_ip": clientIP}).Warn("client rate-limited")
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeRefused)
+		if err := w.WriteMsg(msg); err != nil {
+			log.Error(err)
+		}
+		recordQuery(start, clientIP, q, protocol, "", false, msg)
+		return
+	}
+
+	// Apply blocklists, allowlists, and static rewrites before the
+	// upstream is ever contacted
+	if decision := flt.Check(clientIP, q.Name); decision.Blocked || decision.Rewrite != nil {
+		msg := filterResponse(r, decision)
+		if err := w.WriteMsg(msg); err != nil {
+			log.Error(err)
+		}
+		recordQuery(start, clientIP, q, protocol, "", false, msg)
+		return
+	}
+
+	// Resolve the question against the upstream pool, preserving its
+	// original type so AAAA, MX, TXT, SRV, CNAME, NS, SOA, PTR and
+	// DNSSEC records all round-trip unchanged
+	in, useCache, upstreamAddr, err := resolveOverTLS(r)
+	if err != nil {
+		log.Println(err)
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		if err := w.WriteMsg(msg); err != nil {
+			log.Error(err)
+		}
+		recordQuery(start, clientIP, q, protocol, upstreamAddr, useCache, msg)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"use_cache": useCache,
+		"rcode":     dns.RcodeToString[in.Rcode],
+	}).Info("Cache usage")
+
+	// Build the client reply from the upstream response, keeping the
+	// client's original message ID and question
+	msg := in.Copy()
+	msg.Id = r.Id
+	msg.Question = r.Question
+	msg.Response = true
+
+	// Respect the requester's EDNS0 UDP buffer size so the response
+	// truncates correctly on UDP
+	if protocol == "udp" {
+		bufSize := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			bufSize = int(opt.UDPSize())
 		}
+		msg.Truncate(bufSize)
 	}
-	log.Error("Not implemented yet")
+
+	// Send a response back to a client
+	if err := w.WriteMsg(msg); err != nil {
+		log.Error(err)
+	}
+
+	recordQuery(start, clientIP, q, protocol, upstreamAddr, useCache, msg)
 }
 
-// Resolve domain name by DNS-over-TLS protocol
-func resolveOverTLS(domain, dnsServer string) (Answer, bool, error) {
-	// Answer type return variable
-	var answer Answer
+// recordQuery updates the Prometheus counters and the query log, if
+// enabled, for a completed query. resp is the message actually sent back
+// to the client.
+func recordQuery(start time.Time, clientIP string, q dns.Question, protocol, upstreamAddr string, cacheHit bool, resp *dns.Msg) {
+	qtype := dns.TypeToString[q.Qtype]
+	rcode := dns.RcodeToString[resp.Rcode]
+
+	metrics.ObserveQuery(qtype, rcode, protocol, upstreamAddr)
 
-	// Check in-memory cache
-	if mem, expr, found := inmem.GetWithExpiration(domain); found {
-		answer = mem.(Answer)
-		// Calculate DNS TTL time (expiration time - current time)
-		answer.ttl = uint32(expr.Sub(time.Now()).Seconds())
-		return answer, true, nil
+	if qlog == nil {
+		return
 	}
 
-	// Create new dns message
+	qlog.Log(querylog.Entry{
+		Time:      start,
+		ClientIP:  clientIP,
+		Question:  q.Name,
+		Qtype:     qtype,
+		Answer:    answerSummary(resp),
+		Rcode:     rcode,
+		CacheHit:  cacheHit,
+		Upstream:  upstreamAddr,
+		LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+	})
+}
+
+// answerSummary renders resp's answer section as a compact, comma-separated
+// string for the query log, e.g. "1.2.3.4, 5.6.7.8" for an A answer.
+func answerSummary(resp *dns.Msg) string {
+	if resp == nil || len(resp.Answer) == 0 {
+		return ""
+	}
+
+	parts := make([]string, 0, len(resp.Answer))
+	for _, rr := range resp.Answer {
+		switch v := rr.(type) {
+		case *dns.A:
+			parts = append(parts, v.A.String())
+		case *dns.AAAA:
+			parts = append(parts, v.AAAA.String())
+		case *dns.CNAME:
+			parts = append(parts, v.Target)
+		default:
+			parts = append(parts, rr.String())
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Resolve a DNS question by DNS-over-TLS protocol, forwarding it to the
+// upstream pool unchanged and returning the full upstream response, the
+// address of the upstream that answered (empty on a cache hit), and
+// whether the answer came from the cache
+func resolveOverTLS(r *dns.Msg) (*dns.Msg, bool, string, error) {
+	q := r.Question[0]
+	cacheKey := cache.Key(q.Name, q.Qtype, q.Qclass)
+
+	// Check the answer cache
+	if in, found := answers.Get(cacheKey); found {
+		metrics.ObserveCache(true)
+		return in, true, "", nil
+	}
+	metrics.ObserveCache(false)
+
+	// Create new dns message, preserving the original question
 	m := new(dns.Msg)
+	m.SetQuestion(q.Name, q.Qtype)
+	m.Question[0].Qclass = q.Qclass
 
-	// Set type for new dns message
-	m.SetQuestion(domain, dns.TypeA)
+	// Carry over the requester's EDNS0 OPT record, if any
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), opt.Do())
+	}
 
-	// Setup new DNS client
-	c := new(dns.Client)
+	// Make a DNS query against the upstream pool
+	queryStart := time.Now()
+	in, addr, err := pool.Exchange(m)
+	if err != nil {
+		metrics.ObserveError(addr)
+		return nil, false, addr, errors.Errorf("DNS query error: %v", err)
+	}
+	metrics.ObserveUpstreamRTT(addr, time.Since(queryStart))
 
-	// Use DNS-over-TLS connection type
-	c.Net = "tcp-tls"
+	log.WithFields(log.Fields{
+		"upstream": addr,
+	}).Info("Upstream answered")
 
-	// Make a DNS query
-	in, _, err := c.Exchange(m, dnsServer)
+	answers.Set(cacheKey, in)
+
+	return in, false, addr, nil
+}
+
+// clientIPFromAddr extracts the bare IP from a net.Addr, stripping the port
+// if present, for use as a filter per-client policy key.
+func clientIPFromAddr(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
 	if err != nil {
-		return answer, false, errors.Errorf("DNS query error: %v", err)
+		return addr.String()
 	}
+	return host
+}
+
+// filterResponse builds the reply for a blocked or rewritten question.
+func filterResponse(r *dns.Msg, d filter.Decision) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
 
-	// Check that answer exists
-	if len(in.Answer) > 0 {
-		// Check that DNS response type is A
-		if t, ok := in.Answer[0].(*dns.A); ok {
-			answer.ip = t.A.String()
-			answer.ttl = t.Header().Ttl
+	q := r.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: 60}
+
+	if d.Rewrite != nil {
+		hdr.Rrtype = d.Rewrite.Type
+		switch d.Rewrite.Type {
+		case dns.TypeA:
+			msg.Answer = append(msg.Answer, &dns.A{Hdr: hdr, A: net.ParseIP(d.Rewrite.Value)})
+		case dns.TypeAAAA:
+			msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(d.Rewrite.Value)})
+		case dns.TypeCNAME:
+			msg.Answer = append(msg.Answer, &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(d.Rewrite.Value)})
+		}
+		return msg
+	}
+
+	if d.SinkholeIP != nil && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+		if q.Qtype == dns.TypeA {
+			if ip4 := d.SinkholeIP.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				msg.Answer = append(msg.Answer, &dns.A{Hdr: hdr, A: ip4})
+			}
 		} else {
-			return answer, false, errors.New("DNS query error")
+			// 0.0.0.0 (zero-ip mode) is served as :: for AAAA.
+			aaaa := d.SinkholeIP
+			if aaaa.Equal(net.IPv4zero) {
+				aaaa = net.IPv6zero
+			}
+			hdr.Rrtype = dns.TypeAAAA
+			msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: hdr, AAAA: aaaa})
 		}
+		return msg
+	}
+
+	msg.Rcode = d.Rcode
+	return msg
+}
+
+// refresh re-resolves q against the upstream pool. It is used by the answer
+// cache's prefetch loop to refresh hot entries shortly before they expire.
+func refresh(q dns.Question) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(q.Name, q.Qtype)
+	m.Question[0].Qclass = q.Qclass
+
+	in, addr, err := pool.Exchange(m)
+	if err != nil {
+		return nil, err
 	}
 
-	// Set cache record
-	inmem.Set(domain, answer, time.Duration(int64(answer.ttl))*time.Second)
+	log.WithFields(log.Fields{
+		"upstream": addr,
+	}).Info("Cache prefetch refreshed entry")
 
-	return answer, false, nil
+	return in, nil
 }
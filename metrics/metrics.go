@@ -0,0 +1,112 @@
+// Package metrics exposes Prometheus counters and histograms describing
+// the proxy's query handling.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mxssl/dns-over-tls-proxy/upstream/dot"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// QueriesTotal counts every query handled, by type, response code,
+	// protocol, and the upstream that answered.
+	QueriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_proxy_queries_total",
+		Help: "Total DNS queries handled.",
+	}, []string{"qtype", "rcode", "protocol", "upstream"})
+
+	// CacheHitsTotal and CacheMissesTotal track the answer cache's hit
+	// ratio.
+	CacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dns_proxy_cache_hits_total",
+		Help: "Total queries answered from the cache.",
+	})
+	CacheMissesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dns_proxy_cache_misses_total",
+		Help: "Total queries that missed the cache.",
+	})
+
+	// UpstreamRTTSeconds is the round-trip time of upstream exchanges.
+	UpstreamRTTSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dns_proxy_upstream_rtt_seconds",
+		Help:    "Upstream query round-trip time.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"upstream"})
+
+	// InFlightQueries is the number of queries currently being handled.
+	InFlightQueries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dns_proxy_in_flight_queries",
+		Help: "Number of DNS queries currently being handled.",
+	})
+
+	// ErrorsTotal counts upstream query failures.
+	ErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_proxy_errors_total",
+		Help: "Total upstream query errors.",
+	}, []string{"upstream"})
+
+	// DotPoolConnected reports, per DoT upstream and connection index,
+	// whether that pool connection currently has a live TLS session.
+	DotPoolConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dns_proxy_dot_pool_connected",
+		Help: "Whether a DoT pool connection is currently established (1) or not (0).",
+	}, []string{"upstream", "conn"})
+
+	// DotPoolInFlight reports, per DoT upstream and connection index, how
+	// many pipelined queries that connection is currently carrying.
+	DotPoolInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dns_proxy_dot_pool_in_flight",
+		Help: "Number of pipelined queries currently in flight on a DoT pool connection.",
+	}, []string{"upstream", "conn"})
+)
+
+// Handler serves the Prometheus exposition format for scraping.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveQuery records a completed query's outcome.
+func ObserveQuery(qtype, rcode, protocol, upstream string) {
+	QueriesTotal.WithLabelValues(qtype, rcode, protocol, upstream).Inc()
+}
+
+// ObserveCache records whether a query was served from the cache.
+func ObserveCache(hit bool) {
+	if hit {
+		CacheHitsTotal.Inc()
+	} else {
+		CacheMissesTotal.Inc()
+	}
+}
+
+// ObserveUpstreamRTT records how long an upstream took to answer.
+func ObserveUpstreamRTT(upstream string, d time.Duration) {
+	UpstreamRTTSeconds.WithLabelValues(upstream).Observe(d.Seconds())
+}
+
+// ObserveError records an upstream query failure.
+func ObserveError(upstream string) {
+	ErrorsTotal.WithLabelValues(upstream).Inc()
+}
+
+// ObserveDotPoolStats updates the DoT pool gauges from a snapshot keyed by
+// upstream address, as returned by upstream.Pool.DotStats.
+func ObserveDotPoolStats(stats map[string][]dot.Stats) {
+	for addr, conns := range stats {
+		for i, c := range conns {
+			conn := strconv.Itoa(i)
+			connected := 0.0
+			if c.Connected {
+				connected = 1
+			}
+			DotPoolConnected.WithLabelValues(addr, conn).Set(connected)
+			DotPoolInFlight.WithLabelValues(addr, conn).Set(float64(c.InFlight))
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Package querylog writes a rotating JSONL record of every DNS query
+// handled by the proxy, for auditing and troubleshooting.
+package querylog
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	// defaultMaxSizeMB is the log file size, in megabytes, at which it is
+	// rotated.
+	defaultMaxSizeMB = 100
+	// defaultMaxBackups is how many rotated files are kept.
+	defaultMaxBackups = 7
+	// defaultMaxAgeDays is how long a rotated file is kept before pruning.
+	defaultMaxAgeDays = 28
+)
+
+// Entry is a single logged query, one JSON object per line.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	ClientIP  string    `json:"client_ip"`
+	Question  string    `json:"question"`
+	Qtype     string    `json:"qtype"`
+	Answer    string    `json:"answer,omitempty"`
+	Rcode     string    `json:"rcode"`
+	CacheHit  bool      `json:"cache_hit"`
+	Upstream  string    `json:"upstream,omitempty"`
+	LatencyMs float64   `json:"latency_ms"`
+}
+
+// Logger writes Entry records to a rotating JSONL file.
+type Logger struct {
+	mu        sync.Mutex
+	out       *lumberjack.Logger
+	enc       *json.Encoder
+	anonymize bool
+}
+
+// New creates a Logger writing to path, rotating it once it exceeds 100MB.
+// If anonymize is true, logged client IPs have their low bits zeroed
+// (the last octet for IPv4, the last 80 bits for IPv6) before being
+// recorded.
+func New(path string, anonymize bool) *Logger {
+	out := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    defaultMaxSizeMB,
+		MaxBackups: defaultMaxBackups,
+		MaxAge:     defaultMaxAgeDays,
+	}
+	return &Logger{
+		out:       out,
+		enc:       json.NewEncoder(out),
+		anonymize: anonymize,
+	}
+}
+
+// Log writes e to the log file, anonymizing its client IP first if the
+// Logger was created with anonymize set.
+func (l *Logger) Log(e Entry) {
+	if l.anonymize {
+		e.ClientIP = anonymizeIP(e.ClientIP)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.enc.Encode(e); err != nil {
+		log.Error(err)
+	}
+}
+
+// Close flushes and closes the underlying log file.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.out.Close()
+}
+
+// anonymizeIP zeroes the low bits of ip (the last octet for IPv4, the last
+// 80 bits for IPv6), keeping enough of the address for coarse geolocation
+// or abuse-pattern analysis without identifying a specific client.
+func anonymizeIP(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return s
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		v4[3] = 0
+		return v4.String()
+	}
+
+	masked := ip.Mask(net.CIDRMask(48, 128))
+	return masked.String()
+}
@@ -0,0 +1,80 @@
+// Package ratelimit implements per-client-IP token-bucket rate limiting,
+// used to protect the proxy from being abused as a reflection/amplification
+// vector.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// bucket is a single client's token bucket.
+type bucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// Limiter rate-limits queries per client IP using a token-bucket algorithm:
+// each client accrues tokens at qps per second, up to burst, and spends one
+// token per query.
+type Limiter struct {
+	mu      sync.Mutex
+	qps     float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+// New creates a Limiter allowing qps queries per second per client IP, with
+// bursts of up to burst queries. A qps of 0 disables rate limiting.
+func New(qps float64, burst int) *Limiter {
+	return &Limiter{
+		qps:     qps,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow reports whether a query from clientIP may proceed, spending a token
+// if so. It always returns true when the Limiter was built with qps of 0.
+func (l *Limiter) Allow(clientIP string) bool {
+	if l.qps <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[clientIP]
+	if !ok {
+		b = &bucket{tokens: l.burst, lastSeen: now}
+		l.buckets[clientIP] = b
+	}
+
+	elapsed := now.Sub(b.lastSeen).Seconds()
+	b.lastSeen = now
+	b.tokens += elapsed * l.qps
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// Sweep evicts buckets for clients that haven't been seen since before
+// cutoff, bounding memory use under a churn of many distinct client IPs.
+func (l *Limiter) Sweep(cutoff time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ip, b := range l.buckets {
+		if b.lastSeen.Before(cutoff) {
+			delete(l.buckets, ip)
+		}
+	}
+}
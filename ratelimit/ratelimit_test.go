@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllowDisabledWhenQPSIsZero(t *testing.T) {
+	l := New(0, 1)
+	for i := 0; i < 100; i++ {
+		if !l.Allow("1.2.3.4") {
+			t.Fatal("qps=0 must never rate-limit")
+		}
+	}
+}
+
+func TestAllowSpendsBurstThenBlocks(t *testing.T) {
+	l := New(1, 3)
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow("1.2.3.4") {
+			t.Fatalf("query %d should be allowed within burst", i)
+		}
+	}
+	if l.Allow("1.2.3.4") {
+		t.Fatal("query beyond burst should be rate-limited")
+	}
+}
+
+func TestAllowIsolatesBucketsPerClientIP(t *testing.T) {
+	l := New(1, 1)
+
+	if !l.Allow("1.1.1.1") {
+		t.Fatal("first client's first query should be allowed")
+	}
+	if l.Allow("1.1.1.1") {
+		t.Fatal("first client's second query should be rate-limited")
+	}
+	if !l.Allow("2.2.2.2") {
+		t.Fatal("a different client IP must have its own bucket")
+	}
+}
+
+func TestAllowRefillsOverTime(t *testing.T) {
+	l := New(10, 1)
+
+	if !l.Allow("1.2.3.4") {
+		t.Fatal("first query should be allowed")
+	}
+	if l.Allow("1.2.3.4") {
+		t.Fatal("second immediate query should be rate-limited")
+	}
+
+	// Simulate the passage of time by rewinding the bucket's lastSeen
+	// instead of sleeping in the test.
+	l.mu.Lock()
+	l.buckets["1.2.3.4"].lastSeen = time.Now().Add(-200 * time.Millisecond)
+	l.mu.Unlock()
+
+	if !l.Allow("1.2.3.4") {
+		t.Fatal("expected a token to have accrued after 200ms at 10qps")
+	}
+}
+
+func TestAllowCapsTokensAtBurst(t *testing.T) {
+	l := New(1000, 2)
+
+	l.mu.Lock()
+	l.buckets["1.2.3.4"] = &bucket{tokens: 2, lastSeen: time.Now().Add(-time.Hour)}
+	l.mu.Unlock()
+
+	// Even after a long idle period tokens must not exceed burst, so only
+	// 2 queries should be allowed before the third is rate-limited.
+	if !l.Allow("1.2.3.4") {
+		t.Fatal("expected first query allowed")
+	}
+	if !l.Allow("1.2.3.4") {
+		t.Fatal("expected second query allowed")
+	}
+	if l.Allow("1.2.3.4") {
+		t.Fatal("tokens should have been capped at burst=2, third query should be blocked")
+	}
+}
+
+func TestSweepEvictsOnlyStaleBuckets(t *testing.T) {
+	l := New(1, 1)
+	l.Allow("stale.client")
+	l.Allow("fresh.client")
+
+	l.mu.Lock()
+	l.buckets["stale.client"].lastSeen = time.Now().Add(-time.Hour)
+	l.mu.Unlock()
+
+	l.Sweep(time.Now().Add(-time.Minute))
+
+	l.mu.Lock()
+	_, staleStillThere := l.buckets["stale.client"]
+	_, freshStillThere := l.buckets["fresh.client"]
+	l.mu.Unlock()
+
+	if staleStillThere {
+		t.Error("stale bucket should have been swept")
+	}
+	if !freshStillThere {
+		t.Error("fresh bucket should not have been swept")
+	}
+}
@@ -0,0 +1,72 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// dnsMessageContentType is the RFC 8484 media type for wire-format DNS
+// messages carried over HTTP.
+const dnsMessageContentType = "application/dns-message"
+
+// dohUpstream is a DNS-over-HTTPS Upstream per RFC 8484, querying via HTTP
+// POST with an application/dns-message body over HTTP/2.
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+// NewDoH creates a DNS-over-HTTPS Upstream for url, e.g.
+// "https://cloudflare-dns.com/dns-query".
+func NewDoH(url string, timeout time.Duration) Upstream {
+	return &dohUpstream{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (u *dohUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, errors.Errorf("DoH pack error: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, errors.Errorf("DoH request error: %v", err)
+	}
+	req.Header.Set("Content-Type", dnsMessageContentType)
+	req.Header.Set("Accept", dnsMessageContentType)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, errors.Errorf("DoH query error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("DoH query error: unexpected status %v", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, errors.Errorf("DoH read error: %v", err)
+	}
+
+	in := new(dns.Msg)
+	if err := in.Unpack(body); err != nil {
+		return nil, errors.Errorf("DoH unpack error: %v", err)
+	}
+
+	return in, nil
+}
+
+func (u *dohUpstream) Address() string {
+	return u.url
+}
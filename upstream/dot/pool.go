@@ -0,0 +1,411 @@
+// Package dot maintains a pool of long-lived, pipelined DNS-over-TLS
+// connections to a single resolver, instead of dialing a fresh TLS
+// connection per query.
+package dot
+
+import (
+	"context"
+	"crypto/tls"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultPoolSize is how many parallel connections a Pool opens to
+	// its resolver.
+	DefaultPoolSize = 2
+	// DefaultMaxInFlight bounds how many pipelined queries a single
+	// connection will carry at once.
+	DefaultMaxInFlight = 64
+	// DefaultIdleTimeout is the interval at which a keepalive probe is
+	// sent on an idle connection. Idle connections are not closed.
+	DefaultIdleTimeout = 30 * time.Second
+	// DefaultDialTimeout bounds a single TLS handshake.
+	DefaultDialTimeout = 5 * time.Second
+	// DefaultQueryTimeout bounds how long a query waits for a response.
+	DefaultQueryTimeout = 2 * time.Second
+
+	minBackoff = 200 * time.Millisecond
+	maxBackoff = 30 * time.Second
+
+	// pickPollInterval is how often Exchange re-checks for spare in-flight
+	// capacity while every connection is at MaxInFlight.
+	pickPollInterval = 5 * time.Millisecond
+)
+
+// Config controls Pool sizing and timeouts. The zero value is replaced with
+// the package defaults by NewPool.
+type Config struct {
+	Size         int
+	MaxInFlight  int
+	IdleTimeout  time.Duration
+	DialTimeout  time.Duration
+	QueryTimeout time.Duration
+}
+
+func (c Config) withDefaults() Config {
+	if c.Size <= 0 {
+		c.Size = DefaultPoolSize
+	}
+	if c.MaxInFlight <= 0 {
+		c.MaxInFlight = DefaultMaxInFlight
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = DefaultIdleTimeout
+	}
+	if c.DialTimeout <= 0 {
+		c.DialTimeout = DefaultDialTimeout
+	}
+	if c.QueryTimeout <= 0 {
+		c.QueryTimeout = DefaultQueryTimeout
+	}
+	return c
+}
+
+// Stats reports the current state of a single connection in a Pool.
+type Stats struct {
+	Connected bool
+	InFlight  int
+}
+
+// Pool is a set of pipelined, persistent DNS-over-TLS connections to a
+// single resolver address.
+type Pool struct {
+	addr      string
+	tlsConfig *tls.Config
+	cfg       Config
+
+	mu    sync.Mutex
+	conns []*pipeConn
+	next  int
+}
+
+// NewPool creates a Pool of cfg.Size connections to addr (host:port). TLS
+// session resumption is enabled via a shared ClientSessionCache.
+func NewPool(addr string, cfg Config) *Pool {
+	cfg = cfg.withDefaults()
+
+	p := &Pool{
+		addr: addr,
+		tlsConfig: &tls.Config{
+			ClientSessionCache: tls.NewLRUClientSessionCache(cfg.Size),
+		},
+		cfg: cfg,
+	}
+
+	p.conns = make([]*pipeConn, cfg.Size)
+	for i := range p.conns {
+		p.conns[i] = newPipeConn(addr, p.tlsConfig, cfg)
+	}
+
+	return p
+}
+
+// Exchange sends m over one of the pool's connections, pipelining it
+// alongside any other in-flight queries on that connection, and returns the
+// matching response. The exchange (including any wait for spare capacity)
+// is abandoned once ctx is done or cfg.QueryTimeout elapses, whichever is
+// first.
+func (p *Pool) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	for {
+		c := p.pick()
+		in, err := c.exchange(ctx, m)
+		if err != errAtCapacity {
+			return in, err
+		}
+
+		// Every connection was at cfg.MaxInFlight when we tried to reserve
+		// a slot; wait briefly for one to free up and retry, rather than
+		// treating local saturation as an upstream failure.
+		select {
+		case <-ctx.Done():
+			return nil, errors.Errorf("DoT pool: all %d connections at max in-flight capacity (%d)", len(p.conns), p.cfg.MaxInFlight)
+		case <-time.After(pickPollInterval):
+		}
+	}
+}
+
+// pick round-robins across connections, preferring whichever currently has
+// the fewest in-flight queries. This is a best-effort load-balancing choice
+// only; cfg.MaxInFlight is enforced atomically inside pipeConn.exchange.
+func (p *Pool) pick() *pipeConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	best := p.conns[p.next]
+	for i := 1; i < len(p.conns); i++ {
+		c := p.conns[(p.next+i)%len(p.conns)]
+		if c.load() < best.load() {
+			best = c
+		}
+	}
+	p.next = (p.next + 1) % len(p.conns)
+
+	return best
+}
+
+// Stats returns a snapshot of each connection in the pool.
+func (p *Pool) Stats() []Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make([]Stats, len(p.conns))
+	for i, c := range p.conns {
+		stats[i] = c.stats()
+	}
+	return stats
+}
+
+// Close shuts down every connection in the pool.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, c := range p.conns {
+		c.close()
+	}
+}
+
+// pipeConn owns a single long-lived TLS connection, pipelining queries on
+// it and correlating responses by DNS message ID.
+type pipeConn struct {
+	addr      string
+	tlsConfig *tls.Config
+	cfg       Config
+
+	mu       sync.Mutex
+	co       *dns.Conn
+	pending  map[uint16]chan response
+	nextID   uint16
+	failures int
+
+	dialMu sync.Mutex
+}
+
+type response struct {
+	msg *dns.Msg
+	err error
+}
+
+// errAtCapacity signals that a connection was already at cfg.MaxInFlight
+// when exchange tried to reserve a slot on it, so Pool.Exchange should wait
+// and retry rather than treat this as a query failure.
+var errAtCapacity = errors.New("dot: connection at max in-flight capacity")
+
+func newPipeConn(addr string, tlsConfig *tls.Config, cfg Config) *pipeConn {
+	c := &pipeConn{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		cfg:       cfg,
+		pending:   make(map[uint16]chan response),
+		nextID:    uint16(rand.Intn(1 << 16)),
+	}
+	go c.keepaliveLoop()
+	return c
+}
+
+func (c *pipeConn) load() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+func (c *pipeConn) stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{Connected: c.co != nil, InFlight: len(c.pending)}
+}
+
+// exchange pipelines m on this connection, reconnecting first if needed.
+// The wait for a response is abandoned as soon as ctx is done, though bytes
+// already written to the wire cannot be recalled. Returns errAtCapacity,
+// without writing anything, if the connection is already carrying
+// cfg.MaxInFlight queries.
+func (c *pipeConn) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	co, err := c.ensureConnected(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	originalID := m.Id
+	out := m.Copy()
+
+	c.mu.Lock()
+	if len(c.pending) >= c.cfg.MaxInFlight {
+		c.mu.Unlock()
+		return nil, errAtCapacity
+	}
+	id := c.allocIDLocked()
+	out.Id = id
+	ch := make(chan response, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	if err := co.WriteMsg(out); err != nil {
+		c.reset(co, err)
+		return nil, errors.Errorf("DoT write error: %v", err)
+	}
+
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			return nil, errors.Errorf("DoT read error: %v", res.err)
+		}
+		res.msg.Id = originalID
+		return res.msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(c.cfg.QueryTimeout):
+		return nil, errors.Errorf("DoT query timed out after %v", c.cfg.QueryTimeout)
+	}
+}
+
+// allocIDLocked picks a message ID not already pending. Callers must hold
+// c.mu.
+func (c *pipeConn) allocIDLocked() uint16 {
+	for {
+		id := c.nextID
+		c.nextID++
+		if _, taken := c.pending[id]; !taken {
+			return id
+		}
+	}
+}
+
+// ensureConnected returns the current connection, dialing a new one with
+// exponential backoff if none is established. It gives up once ctx is done.
+func (c *pipeConn) ensureConnected(ctx context.Context) (*dns.Conn, error) {
+	c.dialMu.Lock()
+	defer c.dialMu.Unlock()
+
+	c.mu.Lock()
+	co := c.co
+	c.mu.Unlock()
+	if co != nil {
+		return co, nil
+	}
+
+	backoff := minBackoff
+	var lastErr error
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: c.cfg.DialTimeout}, Config: c.tlsConfig}
+	for attempt := 0; attempt < 5; attempt++ {
+		nc, err := dialer.DialContext(ctx, "tcp", c.addr)
+		if err == nil {
+			co := &dns.Conn{Conn: nc}
+			c.mu.Lock()
+			c.co = co
+			c.failures = 0
+			c.mu.Unlock()
+			go c.readLoop(co)
+			return co, nil
+		}
+
+		lastErr = err
+		log.WithFields(log.Fields{"addr": c.addr, "attempt": attempt}).Warn("DoT dial failed, backing off")
+		select {
+		case <-ctx.Done():
+			return nil, errors.Errorf("DoT dial error: %v", lastErr)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+
+	return nil, errors.Errorf("DoT dial error: %v", lastErr)
+}
+
+// readLoop dispatches responses arriving on co to their waiting caller by
+// message ID until the connection errors out.
+func (c *pipeConn) readLoop(co *dns.Conn) {
+	for {
+		in, err := co.ReadMsg()
+		if err != nil {
+			c.reset(co, err)
+			return
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[in.Id]
+		c.mu.Unlock()
+
+		if ok {
+			ch <- response{msg: in}
+		}
+	}
+}
+
+// reset tears down co after an error and fails every query still waiting
+// on it, so the next exchange redials.
+func (c *pipeConn) reset(co *dns.Conn, err error) {
+	c.mu.Lock()
+	if c.co != co {
+		c.mu.Unlock()
+		return
+	}
+	c.co = nil
+	pending := c.pending
+	c.pending = make(map[uint16]chan response)
+	c.failures++
+	c.mu.Unlock()
+
+	co.Close()
+
+	for _, ch := range pending {
+		ch <- response{err: err}
+	}
+}
+
+func (c *pipeConn) close() {
+	c.mu.Lock()
+	co := c.co
+	c.co = nil
+	c.mu.Unlock()
+
+	if co != nil {
+		co.Close()
+	}
+}
+
+// keepaliveLoop periodically probes the connection with an EDNS0
+// tcp-keepalive query (RFC 7858) so idle connections are not torn down by
+// middleboxes or the resolver.
+func (c *pipeConn) keepaliveLoop() {
+	ticker := time.NewTicker(c.cfg.IdleTimeout)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.mu.Lock()
+		idle := c.co != nil && len(c.pending) == 0
+		c.mu.Unlock()
+		if !idle {
+			continue
+		}
+
+		probe := new(dns.Msg)
+		probe.SetQuestion(".", dns.TypeNS)
+		opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+		probe.Extra = append(probe.Extra, opt)
+
+		if _, err := c.exchange(context.Background(), probe); err != nil {
+			log.WithFields(log.Fields{"addr": c.addr}).Debug("DoT keepalive probe failed")
+		}
+	}
+}
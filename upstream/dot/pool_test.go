@@ -0,0 +1,151 @@
+package dot
+
+import (
+	"testing"
+)
+
+// fakeConn builds a pipeConn with load in-flight queries already pending,
+// without dialing or starting its keepaliveLoop, for pick()/load()/stats()
+// tests that must not touch the network.
+func fakeConn(load int) *pipeConn {
+	c := &pipeConn{pending: make(map[uint16]chan response)}
+	for i := 0; i < load; i++ {
+		c.pending[uint16(i)] = make(chan response, 1)
+	}
+	return c
+}
+
+func testPoolWithConns(conns ...*pipeConn) *Pool {
+	return &Pool{conns: conns}
+}
+
+func TestPickPrefersLeastLoadedConnection(t *testing.T) {
+	busy := fakeConn(5)
+	idle := fakeConn(0)
+	p := testPoolWithConns(busy, idle)
+
+	got := p.pick()
+	if got != idle {
+		t.Fatal("pick() should prefer the connection with fewer in-flight queries")
+	}
+}
+
+func TestPickRoundRobinsOnEqualLoad(t *testing.T) {
+	a := fakeConn(0)
+	b := fakeConn(0)
+	c := fakeConn(0)
+	p := testPoolWithConns(a, b, c)
+
+	// With every connection equally loaded, pick() should cycle through
+	// them starting from p.next rather than always returning the same one.
+	first := p.pick()
+	second := p.pick()
+	third := p.pick()
+	fourth := p.pick()
+
+	if first != a || second != b || third != c || fourth != a {
+		t.Fatalf("pick() sequence = %v, %v, %v, %v; want a, b, c, a (round-robin)",
+			connName(first, a, b, c), connName(second, a, b, c), connName(third, a, b, c), connName(fourth, a, b, c))
+	}
+}
+
+func connName(got, a, b, c *pipeConn) string {
+	switch got {
+	case a:
+		return "a"
+	case b:
+		return "b"
+	case c:
+		return "c"
+	default:
+		return "?"
+	}
+}
+
+func TestPickTieBreaksFromNonZeroCursor(t *testing.T) {
+	// Regression test for a prior bug where tie-breaking was biased toward
+	// conns[0] instead of the round-robin cursor: with every connection
+	// equally loaded and p.next already rotated to a non-zero position,
+	// pick() must still start its scan from p.next, not wrap back to a.
+	a := fakeConn(0)
+	b := fakeConn(0)
+	c := fakeConn(0)
+	p := testPoolWithConns(a, b, c)
+	p.next = 2 // simulate having already rotated past a and b
+
+	if got := p.pick(); got != c {
+		t.Fatalf("pick() with p.next=2 and all loads tied = %s, want c", connName(got, a, b, c))
+	}
+}
+
+func TestPickStopsReturningConnectionOnceItGetsBusier(t *testing.T) {
+	// Once a connection becomes busier than its neighbor, pick() must stop
+	// returning it even though it was the previous round's pick.
+	a := fakeConn(0)
+	b := fakeConn(0)
+	p := testPoolWithConns(a, b)
+
+	if got := p.pick(); got != a {
+		t.Fatal("expected a picked first")
+	}
+	// a now picks up load from the query it was just handed.
+	a.pending[100] = make(chan response, 1)
+
+	if got := p.pick(); got != b {
+		t.Fatal("expected b picked next since a now has more in-flight load")
+	}
+}
+
+func TestLoadReflectsPendingCount(t *testing.T) {
+	c := fakeConn(3)
+	if got := c.load(); got != 3 {
+		t.Fatalf("load() = %d, want 3", got)
+	}
+}
+
+func TestStatsReportsConnectedAndInFlight(t *testing.T) {
+	c := fakeConn(2)
+	st := c.stats()
+	if st.Connected {
+		t.Error("stats().Connected should be false before ensureConnected dials")
+	}
+	if st.InFlight != 2 {
+		t.Errorf("stats().InFlight = %d, want 2", st.InFlight)
+	}
+}
+
+func TestPoolStatsAggregatesEveryConnection(t *testing.T) {
+	p := testPoolWithConns(fakeConn(1), fakeConn(4))
+
+	stats := p.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("len(Stats()) = %d, want 2", len(stats))
+	}
+	if stats[0].InFlight != 1 || stats[1].InFlight != 4 {
+		t.Errorf("Stats() = %+v, want InFlight 1 then 4", stats)
+	}
+}
+
+func TestConfigWithDefaults(t *testing.T) {
+	cfg := Config{}.withDefaults()
+	if cfg.Size != DefaultPoolSize {
+		t.Errorf("Size = %d, want %d", cfg.Size, DefaultPoolSize)
+	}
+	if cfg.MaxInFlight != DefaultMaxInFlight {
+		t.Errorf("MaxInFlight = %d, want %d", cfg.MaxInFlight, DefaultMaxInFlight)
+	}
+	if cfg.IdleTimeout != DefaultIdleTimeout {
+		t.Errorf("IdleTimeout = %v, want %v", cfg.IdleTimeout, DefaultIdleTimeout)
+	}
+	if cfg.DialTimeout != DefaultDialTimeout {
+		t.Errorf("DialTimeout = %v, want %v", cfg.DialTimeout, DefaultDialTimeout)
+	}
+	if cfg.QueryTimeout != DefaultQueryTimeout {
+		t.Errorf("QueryTimeout = %v, want %v", cfg.QueryTimeout, DefaultQueryTimeout)
+	}
+
+	explicit := Config{Size: 7, MaxInFlight: 9, IdleTimeout: 1, DialTimeout: 1, QueryTimeout: 1}.withDefaults()
+	if explicit.Size != 7 || explicit.MaxInFlight != 9 {
+		t.Errorf("withDefaults should not override already-set fields, got %+v", explicit)
+	}
+}
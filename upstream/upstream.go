@@ -0,0 +1,338 @@
+// Package upstream provides pluggable DNS-over-TLS and DNS-over-HTTPS
+// upstream resolvers and a Pool that can race, rank, or fail over between
+// several of them, similar in spirit to how dnsproxy separates upstream
+// selection from the DNS server loop.
+package upstream
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/mxssl/dns-over-tls-proxy/upstream/dot"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Strategy selects how a Pool picks an Upstream for a given query.
+type Strategy string
+
+const (
+	// StrategyParallel fires the query at every upstream at once and
+	// returns the first successful response, cancelling the rest.
+	StrategyParallel Strategy = "parallel"
+	// StrategyFastest tracks a per-upstream EWMA of round-trip time and
+	// always queries the upstream with the lowest average RTT.
+	StrategyFastest Strategy = "fastest"
+	// StrategyFailover tries upstreams in order, skipping any that are
+	// currently marked unhealthy.
+	StrategyFailover Strategy = "failover"
+)
+
+const (
+	// ewmaAlpha weights how much a fresh RTT sample moves the average.
+	ewmaAlpha = 0.3
+	// defaultMaxFailures is how many consecutive failures mark an
+	// upstream unhealthy.
+	defaultMaxFailures = 3
+	// defaultCooldown is how long an unhealthy upstream is skipped for.
+	defaultCooldown = 30 * time.Second
+	// DefaultTimeout bounds a single upstream exchange unless overridden
+	// per-address in the resolver list.
+	DefaultTimeout = 2 * time.Second
+)
+
+// Upstream resolves a DNS message against a single resolver.
+type Upstream interface {
+	// Exchange sends m to the resolver and returns its response. The
+	// exchange is abandoned as soon as ctx is done, though bytes already
+	// written to the wire cannot be recalled.
+	Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	// Address returns the upstream's configured address, used for logging.
+	Address() string
+}
+
+// dotUpstream is a DNS-over-TLS Upstream backed by a *dot.Pool of
+// persistent connections.
+type dotUpstream struct {
+	addr string
+	pool *dot.Pool
+}
+
+// NewDoT creates a DNS-over-TLS Upstream for addr (host:port), backed by a
+// pool of persistent, pipelined connections rather than dialing per query.
+func NewDoT(addr string, cfg dot.Config) Upstream {
+	return &dotUpstream{
+		addr: addr,
+		pool: dot.NewPool(addr, cfg),
+	}
+}
+
+func (u *dotUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	in, err := u.pool.Exchange(ctx, m)
+	if err != nil {
+		return nil, errors.Errorf("DNS query error: %v", err)
+	}
+	return in, nil
+}
+
+func (u *dotUpstream) Address() string {
+	return u.addr
+}
+
+// Stats returns a snapshot of each connection in the upstream's pool.
+func (u *dotUpstream) Stats() []dot.Stats {
+	return u.pool.Stats()
+}
+
+// newUpstream builds an Upstream for addr, treating http(s):// addresses as
+// DNS-over-HTTPS (RFC 8484) and anything else as DNS-over-TLS host:port
+// backed by a connection pool sized and timed out per cfg.
+func newUpstream(addr string, cfg dot.Config) Upstream {
+	if strings.HasPrefix(addr, "https://") || strings.HasPrefix(addr, "http://") {
+		return NewDoH(addr, cfg.QueryTimeout)
+	}
+	return NewDoT(addr, cfg)
+}
+
+// parseAddr splits a resolver address on a trailing "@duration" override,
+// e.g. "1.1.1.1:853@500ms", so individual upstreams can use a tighter or
+// looser query timeout than the pool-wide default. Addresses without a
+// valid suffix are returned unchanged, using def.
+func parseAddr(addr string, def time.Duration) (string, time.Duration) {
+	if i := strings.LastIndex(addr, "@"); i != -1 {
+		if d, err := time.ParseDuration(addr[i+1:]); err == nil {
+			return addr[:i], d
+		}
+	}
+	return addr, def
+}
+
+// member wraps an Upstream with the health and latency bookkeeping a Pool
+// needs to implement its strategies.
+type member struct {
+	Upstream
+
+	mu                  sync.Mutex
+	ewma                time.Duration
+	consecutiveFailures int
+	unhealthyUntil      time.Time
+}
+
+func (m *member) recordSuccess(rtt time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ewma == 0 {
+		m.ewma = rtt
+	} else {
+		m.ewma = time.Duration(float64(rtt)*ewmaAlpha + float64(m.ewma)*(1-ewmaAlpha))
+	}
+	m.consecutiveFailures = 0
+	m.unhealthyUntil = time.Time{}
+}
+
+func (m *member) recordFailure(maxFailures int, cooldown time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.consecutiveFailures++
+	if m.consecutiveFailures >= maxFailures {
+		m.unhealthyUntil = time.Now().Add(cooldown)
+	}
+}
+
+func (m *member) healthy() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return time.Now().After(m.unhealthyUntil)
+}
+
+func (m *member) rtt() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.ewma
+}
+
+// Pool selects one or more Upstream resolvers for a query according to a
+// Strategy and tracks their health.
+type Pool struct {
+	strategy    Strategy
+	members     []*member
+	maxFailures int
+	cooldown    time.Duration
+}
+
+// NewPool builds a Pool from a comma-separated list of resolver addresses,
+// using strategy to pick between them. Each address is either a DoT
+// host:port (e.g. "1.1.1.1:853") or a DoH URL (e.g.
+// "https://cloudflare-dns.com/dns-query"), optionally suffixed with
+// "@duration" to override the query timeout for that one upstream, e.g.
+// "1.1.1.1:853@500ms,8.8.8.8:853". dotCfg controls DoT connection pool
+// sizing and timeouts; its QueryTimeout is the default applied to every
+// upstream (including DoH) unless overridden per-address.
+func NewPool(resolvers string, strategy Strategy, dotCfg dot.Config) (*Pool, error) {
+	addrs := strings.Split(resolvers, ",")
+
+	members := make([]*member, 0, len(addrs))
+	for _, raw := range addrs {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		addr, timeout := parseAddr(raw, dotCfg.QueryTimeout)
+		cfg := dotCfg
+		cfg.QueryTimeout = timeout
+		members = append(members, &member{Upstream: newUpstream(addr, cfg)})
+	}
+
+	if len(members) == 0 {
+		return nil, errors.New("upstream: no resolvers configured")
+	}
+
+	return &Pool{
+		strategy:    strategy,
+		members:     members,
+		maxFailures: defaultMaxFailures,
+		cooldown:    defaultCooldown,
+	}, nil
+}
+
+// DotStats returns a snapshot of every DoT upstream's connection pool,
+// keyed by upstream address, for exporting as metrics. Non-DoT upstreams
+// (DoH) are omitted, since they have no persistent pool to report on.
+func (p *Pool) DotStats() map[string][]dot.Stats {
+	stats := make(map[string][]dot.Stats)
+	for _, mem := range p.members {
+		if dotMem, ok := mem.Upstream.(*dotUpstream); ok {
+			stats[dotMem.Address()] = dotMem.Stats()
+		}
+	}
+	return stats
+}
+
+// Exchange resolves m against the pool, returning the response and the
+// address of the upstream that answered.
+func (p *Pool) Exchange(m *dns.Msg) (*dns.Msg, string, error) {
+	switch p.strategy {
+	case StrategyParallel:
+		return p.exchangeParallel(m)
+	case StrategyFastest:
+		return p.exchangeFastest(m)
+	default:
+		return p.exchangeFailover(m)
+	}
+}
+
+func (p *Pool) exchangeFailover(m *dns.Msg) (*dns.Msg, string, error) {
+	var lastErr error
+
+	for _, mem := range p.members {
+		if !mem.healthy() {
+			continue
+		}
+
+		start := time.Now()
+		in, err := mem.Exchange(context.Background(), m)
+		if err != nil {
+			lastErr = err
+			mem.recordFailure(p.maxFailures, p.cooldown)
+			log.WithFields(log.Fields{"upstream": mem.Address()}).Warn("upstream failed, trying next")
+			continue
+		}
+
+		mem.recordSuccess(time.Since(start))
+		return in, mem.Address(), nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("upstream: all resolvers unhealthy")
+	}
+	return nil, "", lastErr
+}
+
+func (p *Pool) exchangeFastest(m *dns.Msg) (*dns.Msg, string, error) {
+	var best *member
+	for _, mem := range p.members {
+		if !mem.healthy() {
+			continue
+		}
+		if best == nil || mem.rtt() < best.rtt() {
+			best = mem
+		}
+	}
+
+	if best == nil {
+		return p.exchangeFailover(m)
+	}
+
+	start := time.Now()
+	in, err := best.Exchange(context.Background(), m)
+	if err != nil {
+		best.recordFailure(p.maxFailures, p.cooldown)
+		return p.exchangeFailover(m)
+	}
+
+	best.recordSuccess(time.Since(start))
+	return in, best.Address(), nil
+}
+
+type parallelResult struct {
+	msg  *dns.Msg
+	addr string
+	err  error
+}
+
+// exchangeParallel fires m at every member concurrently and returns the
+// first successful response. ctx is cancelled as soon as this function
+// returns (the defer below fires on the first winner), so any upstream
+// still waiting on a reply abandons that wait immediately instead of
+// blocking for its full query timeout. Cancellation cannot unsend a query
+// already written to the wire, but it does stop the loser from holding a
+// pipelined connection slot and a goroutine for the rest of the timeout.
+func (p *Pool) exchangeParallel(m *dns.Msg) (*dns.Msg, string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan parallelResult, len(p.members))
+
+	for _, mem := range p.members {
+		mem := mem
+		go func() {
+			start := time.Now()
+			in, err := mem.Exchange(ctx, m)
+			switch {
+			case err != nil && ctx.Err() != nil:
+				// Lost the race, not an actual upstream failure.
+			case err != nil:
+				mem.recordFailure(p.maxFailures, p.cooldown)
+			default:
+				mem.recordSuccess(time.Since(start))
+			}
+
+			select {
+			case results <- parallelResult{msg: in, addr: mem.Address(), err: err}:
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	var lastErr error
+	for range p.members {
+		res := <-results
+		if res.err != nil {
+			lastErr = res.err
+			continue
+		}
+		return res.msg, res.addr, nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("upstream: all resolvers failed")
+	}
+	return nil, "", lastErr
+}
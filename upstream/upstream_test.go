@@ -0,0 +1,245 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeUpstream is an in-memory Upstream test double so Pool strategy tests
+// never touch the network.
+type fakeUpstream struct {
+	addr  string
+	delay time.Duration
+	fail  bool
+	calls int32
+}
+
+func (f *fakeUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&f.calls, 1)
+	if f.delay > 0 {
+		select {
+		case <-time.After(f.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if f.fail {
+		return nil, errTestUpstream
+	}
+	return new(dns.Msg), nil
+}
+
+func (f *fakeUpstream) Address() string {
+	return f.addr
+}
+
+func (f *fakeUpstream) Calls() int {
+	return int(atomic.LoadInt32(&f.calls))
+}
+
+var errTestUpstream = errors.New("fake upstream failure")
+
+func testPool(strategy Strategy, members ...*member) *Pool {
+	return &Pool{
+		strategy:    strategy,
+		members:     members,
+		maxFailures: defaultMaxFailures,
+		cooldown:    defaultCooldown,
+	}
+}
+
+func TestExchangeFailoverSkipsUnhealthyMembers(t *testing.T) {
+	bad := &fakeUpstream{addr: "bad", fail: true}
+	good := &fakeUpstream{addr: "good"}
+	badMem := &member{Upstream: bad}
+	badMem.unhealthyUntil = time.Now().Add(time.Minute)
+	goodMem := &member{Upstream: good}
+
+	p := testPool(StrategyFailover, badMem, goodMem)
+
+	_, addr, err := p.Exchange(new(dns.Msg))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if addr != "good" {
+		t.Fatalf("addr = %q, want %q", addr, "good")
+	}
+	if bad.Calls() != 0 {
+		t.Fatalf("unhealthy member should not have been queried, got %d calls", bad.Calls())
+	}
+}
+
+func TestExchangeFailoverFallsThroughOnError(t *testing.T) {
+	bad := &fakeUpstream{addr: "bad", fail: true}
+	good := &fakeUpstream{addr: "good"}
+	badMem := &member{Upstream: bad}
+	goodMem := &member{Upstream: good}
+
+	p := testPool(StrategyFailover, badMem, goodMem)
+
+	_, addr, err := p.Exchange(new(dns.Msg))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if addr != "good" {
+		t.Fatalf("addr = %q, want %q", addr, "good")
+	}
+	if badMem.consecutiveFailures != 1 {
+		t.Errorf("badMem.consecutiveFailures = %d, want 1", badMem.consecutiveFailures)
+	}
+}
+
+func TestExchangeFailoverRecordsRealRTTNotZero(t *testing.T) {
+	slow := &fakeUpstream{addr: "slow", delay: 20 * time.Millisecond}
+	mem := &member{Upstream: slow}
+	p := testPool(StrategyFailover, mem)
+
+	if _, _, err := p.Exchange(new(dns.Msg)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mem.rtt() < 10*time.Millisecond {
+		t.Fatalf("rtt() = %v, want at least ~20ms (not a fabricated 0)", mem.rtt())
+	}
+}
+
+func TestExchangeFailoverAllUnhealthyReturnsError(t *testing.T) {
+	mem := &member{Upstream: &fakeUpstream{addr: "a"}}
+	mem.unhealthyUntil = time.Now().Add(time.Minute)
+	p := testPool(StrategyFailover, mem)
+
+	if _, _, err := p.Exchange(new(dns.Msg)); err == nil {
+		t.Fatal("expected an error when every member is unhealthy")
+	}
+}
+
+func TestExchangeFastestPicksLowestRTT(t *testing.T) {
+	slowMem := &member{Upstream: &fakeUpstream{addr: "slow"}}
+	slowMem.ewma = 100 * time.Millisecond
+	fastMem := &member{Upstream: &fakeUpstream{addr: "fast"}}
+	fastMem.ewma = 5 * time.Millisecond
+
+	p := testPool(StrategyFastest, slowMem, fastMem)
+
+	_, addr, err := p.Exchange(new(dns.Msg))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if addr != "fast" {
+		t.Fatalf("addr = %q, want %q (lowest EWMA)", addr, "fast")
+	}
+}
+
+func TestExchangeFastestFallsBackToFailoverOnError(t *testing.T) {
+	failing := &fakeUpstream{addr: "failing", fail: true}
+	failingMem := &member{Upstream: failing}
+	failingMem.ewma = 1 * time.Millisecond // looks fastest but errors
+
+	backup := &fakeUpstream{addr: "backup"}
+	backupMem := &member{Upstream: backup}
+	backupMem.ewma = 50 * time.Millisecond
+
+	p := testPool(StrategyFastest, failingMem, backupMem)
+
+	_, addr, err := p.Exchange(new(dns.Msg))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if addr != "backup" {
+		t.Fatalf("addr = %q, want %q (failover after fastest errors)", addr, "backup")
+	}
+	// exchangeFastest records one failure itself, then falls back to
+	// exchangeFailover, which tries every healthy member in order
+	// (including the same still-healthy failingMem again) and records a
+	// second failure for it before reaching backup.
+	if failingMem.consecutiveFailures != 2 {
+		t.Errorf("failingMem.consecutiveFailures = %d, want 2", failingMem.consecutiveFailures)
+	}
+}
+
+func TestExchangeParallelReturnsFirstSuccess(t *testing.T) {
+	slow := &fakeUpstream{addr: "slow", delay: 50 * time.Millisecond}
+	fast := &fakeUpstream{addr: "fast", delay: 5 * time.Millisecond}
+	slowMem := &member{Upstream: slow}
+	fastMem := &member{Upstream: fast}
+
+	p := testPool(StrategyParallel, slowMem, fastMem)
+
+	_, addr, err := p.Exchange(new(dns.Msg))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if addr != "fast" {
+		t.Fatalf("addr = %q, want %q", addr, "fast")
+	}
+}
+
+func TestExchangeParallelAllFailReturnsError(t *testing.T) {
+	a := &member{Upstream: &fakeUpstream{addr: "a", fail: true}}
+	b := &member{Upstream: &fakeUpstream{addr: "b", fail: true}}
+
+	p := testPool(StrategyParallel, a, b)
+
+	if _, _, err := p.Exchange(new(dns.Msg)); err == nil {
+		t.Fatal("expected an error when every member fails")
+	}
+}
+
+func TestMemberRecordFailureMarksUnhealthyAfterMaxFailures(t *testing.T) {
+	m := &member{}
+	for i := 0; i < defaultMaxFailures-1; i++ {
+		m.recordFailure(defaultMaxFailures, defaultCooldown)
+		if !m.healthy() {
+			t.Fatalf("member should still be healthy after %d failures", i+1)
+		}
+	}
+	m.recordFailure(defaultMaxFailures, defaultCooldown)
+	if m.healthy() {
+		t.Fatal("member should be unhealthy after reaching maxFailures")
+	}
+}
+
+func TestMemberRecordSuccessResetsFailuresAndUpdatesEWMA(t *testing.T) {
+	m := &member{}
+	m.recordFailure(1, time.Minute)
+	if m.healthy() {
+		t.Fatal("expected unhealthy after a single failure with maxFailures=1")
+	}
+
+	m.recordSuccess(10 * time.Millisecond)
+	if !m.healthy() {
+		t.Fatal("recordSuccess should clear the unhealthy state")
+	}
+	if m.consecutiveFailures != 0 {
+		t.Errorf("consecutiveFailures = %d, want 0", m.consecutiveFailures)
+	}
+	if m.rtt() != 10*time.Millisecond {
+		t.Errorf("rtt() = %v, want 10ms on first sample", m.rtt())
+	}
+
+	m.recordSuccess(20 * time.Millisecond)
+	if got := m.rtt(); got <= 10*time.Millisecond || got >= 20*time.Millisecond {
+		t.Errorf("rtt() = %v, want an EWMA strictly between 10ms and 20ms", got)
+	}
+}
+
+func TestParseAddrSuffix(t *testing.T) {
+	addr, timeout := parseAddr("1.1.1.1:853@500ms", DefaultTimeout)
+	if addr != "1.1.1.1:853" || timeout != 500*time.Millisecond {
+		t.Errorf("parseAddr with suffix = (%q, %v), want (%q, 500ms)", addr, timeout, "1.1.1.1:853")
+	}
+
+	addr, timeout = parseAddr("1.1.1.1:853", DefaultTimeout)
+	if addr != "1.1.1.1:853" || timeout != DefaultTimeout {
+		t.Errorf("parseAddr without suffix = (%q, %v), want (%q, %v)", addr, timeout, "1.1.1.1:853", DefaultTimeout)
+	}
+
+	addr, timeout = parseAddr("1.1.1.1:853@not-a-duration", DefaultTimeout)
+	if addr != "1.1.1.1:853@not-a-duration" || timeout != DefaultTimeout {
+		t.Errorf("parseAddr with invalid suffix should pass the address through unchanged, got (%q, %v)", addr, timeout)
+	}
+}